@@ -0,0 +1,75 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package cloud defines a small provider-agnostic abstraction over
+// the cloud APIs used to create, list, tag, and destroy the virtual
+// machines that back a Reflow cluster: a single InstanceSet
+// represents all of the instances belonging to one cluster in one
+// cloud account/region, and an Instance represents a single running
+// (or terminating) VM.
+//
+// Concrete implementations live alongside the cluster code that
+// uses them, e.g. ec2cluster/ec2driver for AWS EC2 and
+// ec2cluster/gcedriver for Google Compute Engine. Cluster-level
+// logic (scheduling, waiter bookkeeping, reconciliation) is written
+// against these interfaces so that it does not need to change when
+// a new cloud is supported.
+package cloud
+
+import (
+	"context"
+
+	"github.com/grailbio/reflow"
+)
+
+// Tags is a set of key-value pairs attached to a cloud instance. It
+// is used both to request tags at creation time and to read the
+// tags of an existing instance.
+type Tags map[string]string
+
+// InstanceType describes the shape of instance to create: its
+// resources and any provider-specific type identifier (e.g. an EC2
+// instance type name or a GCE machine type).
+type InstanceType struct {
+	// Name is the provider-specific type identifier, e.g. "m4.xlarge".
+	Name string
+	// Resources is the set of resources ("cpu", "mem", "disk", ...)
+	// provided by an instance of this type.
+	Resources reflow.Resources
+	// Spot indicates that a preemptible/spot instance should be
+	// requested, where the provider supports it.
+	Spot bool
+}
+
+// Instance represents a single instance (VM) managed by an
+// InstanceSet.
+type Instance interface {
+	// ID returns the provider-specific instance identifier.
+	ID() string
+	// Address returns the instance's reachable network address
+	// (typically its public DNS name or IP), or "" if the instance
+	// does not yet have one (e.g. it is still booting).
+	Address() string
+	// State returns the provider's view of the instance's lifecycle
+	// state (e.g. "pending", "running", "shutting-down").
+	State() string
+	// Tags returns the tags currently attached to the instance.
+	Tags() Tags
+}
+
+// InstanceSet represents all of the instances belonging to a single
+// Reflow cluster in a single cloud account/region. Implementations
+// need not be safe for concurrent use unless noted otherwise.
+type InstanceSet interface {
+	// Create launches a new instance of the given type, tagged with
+	// tags, and returns it. The instance may not yet be reachable;
+	// callers are expected to probe it for readiness.
+	Create(ctx context.Context, typ InstanceType, tags Tags) (Instance, error)
+	// List returns the instances in this set that match tags. A nil
+	// or empty tags filters to all instances known to this set.
+	List(ctx context.Context, tags Tags) ([]Instance, error)
+	// Destroy terminates the instance with the given ID. Destroying
+	// an already-terminated or nonexistent instance is not an error.
+	Destroy(ctx context.Context, id string) error
+}
@@ -14,13 +14,22 @@
 // The VM instances are configured to terminate if they are idle on
 // EC2's billing hour boundary. They also terminate on any fatal
 // reflowlet error.
+//
+// Cluster's own bookkeeping (scheduling, waiter queueing, and
+// reconciliation of cloud state against c.File) is written against
+// the provider-agnostic cloud.InstanceSet interface rather than
+// directly against ec2iface.EC2API, so that a non-EC2 driver (see
+// ec2cluster/ec2driver and ec2cluster/gcedriver) can in principle be
+// substituted. Instance launching is still EC2-specific, since it
+// depends on details (AMIs, user data, spot requests) that have no
+// cloud-neutral representation yet.
 package ec2cluster
 
 import (
 	"context"
 	"fmt"
 	"net/http"
-	"sort"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -28,19 +37,19 @@ import (
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/grailbio/base/state"
 	"github.com/grailbio/reflow"
+	"github.com/grailbio/reflow/cloud"
 	"github.com/grailbio/reflow/config"
+	"github.com/grailbio/reflow/ec2cluster/ec2driver"
 	"github.com/grailbio/reflow/errors"
 	"github.com/grailbio/reflow/internal/ecrauth"
 	"github.com/grailbio/reflow/log"
 	"github.com/grailbio/reflow/pool"
 	"github.com/grailbio/reflow/pool/client"
+	"github.com/grailbio/reflow/scheduler"
 )
 
 const (
-	ec2PollInterval = time.Minute
-	// ec2MaxFilter is the maximum number of filter expressions
-	// that are permitted in EC2 API calls.
-	ec2MaxFilter      = 200
+	ec2PollInterval   = time.Minute
 	statePollInterval = 10 * time.Second
 )
 
@@ -107,6 +116,53 @@ type Cluster struct {
 	Immortal bool
 	// CloudConfig is merged into the instance's cloudConfig before launching.
 	CloudConfig cloudConfig
+	// SSH is used to run the boot probe and, as a fallback, liveness
+	// probes against instances whose reflowlet HTTPS endpoint is
+	// unreachable. If nil, instances are tracked by workers but only
+	// ever probed over HTTPS.
+	SSH sshExecutor
+	// BootProbeCommand is the command run over SSH to verify that an
+	// instance's reflowlet started successfully.
+	BootProbeCommand string
+	// BootTimeout bounds how long an instance may sit in the booting
+	// state before its boot is considered to have failed.
+	BootTimeout time.Duration
+	// OrphanGracePeriod bounds how long Init's stale-lock recovery
+	// pass waits for an orphaned instance's reflowlet to answer a
+	// liveness probe before terminating it. Defaults to 5 minutes.
+	OrphanGracePeriod time.Duration
+	// IdleTimeout, if nonzero, terminates an instance once it has had
+	// no running alloc for this long, independent of the reflowlet's
+	// own billing-hour self-terminate.
+	IdleTimeout time.Duration
+	// MinIdle is the number of instances of the cluster's
+	// most-requested instance type to keep warm regardless of
+	// IdleTimeout, so that a burst of Allocate calls doesn't have to
+	// wait out a launch on its first alloc.
+	MinIdle int
+
+	// Driver is the cloud.InstanceSet used to list and destroy
+	// instances belonging to this cluster. If nil, Init sets it to an
+	// ec2driver wrapping c.EC2, so existing callers that only set EC2
+	// continue to work unchanged; callers that want a different cloud
+	// provider (see ec2cluster/gcedriver) set Driver themselves before
+	// calling Init.
+	//
+	// Note that launching new instances is not yet routed through
+	// Driver.Create; it goes through (*instance).Go, which is
+	// EC2-specific and requires EC2. A cluster configured with a
+	// non-EC2 Driver and no EC2 client can still discover and
+	// terminate instances through Driver, but loop() will refuse to
+	// launch new ones rather than panic on a nil EC2 client.
+	Driver cloud.InstanceSet
+
+	// workers tracks the boot/health state machine of every instance
+	// in the cluster; see workerPool.
+	workers *workerPool
+
+	// metrics holds the Prometheus collectors served by
+	// MetricsHandler.
+	metrics *clusterMetrics
 
 	instanceState *instanceState
 	pools         map[string]pool.Pool
@@ -116,8 +172,9 @@ type Cluster struct {
 
 type waiter struct {
 	reflow.Requirements
-	ctx context.Context
-	c   chan struct{}
+	ctx   context.Context
+	c     chan struct{}
+	start time.Time
 }
 
 func (w *waiter) Notify() {
@@ -160,6 +217,30 @@ func (c *Cluster) Init() error {
 		return errors.New("no configured instance types")
 	}
 	c.instanceState = newInstanceState(instances, 5*time.Minute, c.Region)
+	if c.Driver == nil {
+		c.Driver = ec2driver.New(c.EC2)
+	}
+	bootTimeout := c.BootTimeout
+	if bootTimeout == 0 {
+		bootTimeout = 10 * time.Minute
+	}
+	c.workers = newWorkerPool(c.HTTPClient, c.SSH, c.BootProbeCommand, bootTimeout, c.Log)
+	c.workers.Allocs = func(ctx context.Context, id string) ([]pool.Alloc, error) {
+		lister, ok := c.pools[id].(allocLister)
+		if !ok {
+			return nil, nil
+		}
+		return lister.Allocs(ctx)
+	}
+	c.metrics = newClusterMetrics()
+
+	// Recover from a previous incarnation of this process having
+	// crashed: adopt or terminate any instance EC2 reports as
+	// belonging to this cluster (by Tag) that is missing from our
+	// persisted state, before the maintain/loop goroutines start.
+	if err := c.fixStaleLocks(); err != nil {
+		c.Log.Printf("fix stale locks: %v", err)
+	}
 
 	c.update()
 	go c.maintain()
@@ -167,6 +248,114 @@ func (c *Cluster) Init() error {
 	return nil
 }
 
+// fixStaleLocks discovers instances tagged as belonging to this
+// cluster that are missing from c.File's persisted instance list --
+// e.g. because a previous reflow process launched them and then
+// crashed before recording them -- and either re-adopts them (if
+// their reflowlet answers a liveness probe) or terminates them (if
+// they don't, within OrphanGracePeriod). It is called once, from
+// Init, before the maintain and loop goroutines start.
+//
+// Orphan discovery goes through c.Driver, so it works under any
+// cloud.InstanceSet. Adoption itself does not: c.File's schema
+// stores a full *ec2.Instance per instance (instance type, launch
+// time, and other fields cloud.Instance doesn't expose), so
+// re-hydrating an adopted instance's record requires a second,
+// EC2-specific DescribeInstances call, paged through
+// (*ec2driver.Driver).DescribeByIds since a crash can leak more
+// orphans than fit in a single EC2 filter. Under a non-EC2 driver
+// (c.EC2 nil), fixStaleLocks neither adopts nor terminates orphans:
+// it logs how many it found and returns. Nothing else in Cluster
+// reclaims them later, since reconcile and reapIdle act only on
+// instances recorded in c.File.
+func (c *Cluster) fixStaleLocks() error {
+	var known map[string]*ec2.Instance
+	if err := c.File.Unmarshal(&known); err != nil && err != state.ErrNoState {
+		return err
+	}
+	cloudInstances, err := c.Driver.List(context.Background(), cloud.Tags{"reflow": c.Tag})
+	if err != nil {
+		return err
+	}
+	var orphanIds []string
+	for _, inst := range cloudInstances {
+		if known[inst.ID()] != nil {
+			continue
+		}
+		switch inst.State() {
+		case "shutting-down", "terminated", "stopping", "stopped":
+			continue
+		}
+		if inst.Address() == "" {
+			c.Log.Printf("orphan instance %s has no address yet; leaving it unadopted", inst.ID())
+			continue
+		}
+		orphanIds = append(orphanIds, inst.ID())
+	}
+	if len(orphanIds) == 0 {
+		return nil
+	}
+	if c.EC2 == nil {
+		c.Log.Printf("no EC2 client configured; leaving %d orphan instance(s) neither adopted nor terminated", len(orphanIds))
+		return nil
+	}
+	live, err := ec2driver.New(c.EC2).DescribeByIds(orphanIds)
+	if err != nil {
+		return err
+	}
+	grace := c.OrphanGracePeriod
+	if grace == 0 {
+		grace = 5 * time.Minute
+	}
+	var adopt []*ec2.Instance
+	var terminate []string
+	for _, inst := range live {
+		if aws.StringValue(inst.PublicDnsName) == "" {
+			c.Log.Printf("orphan instance %s has no address yet; leaving it unadopted", aws.StringValue(inst.InstanceId))
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		healthy := c.workers.livenessProbe(ctx, aws.StringValue(inst.PublicDnsName))
+		cancel()
+		if healthy {
+			c.Log.Printf("adopting orphan instance %s found on restart", aws.StringValue(inst.InstanceId))
+			c.workers.TrackAdopted(aws.StringValue(inst.InstanceId), aws.StringValue(inst.PublicDnsName))
+			adopt = append(adopt, inst)
+		} else {
+			c.Log.Printf("orphan instance %s unreachable past grace period; terminating", aws.StringValue(inst.InstanceId))
+			terminate = append(terminate, aws.StringValue(inst.InstanceId))
+		}
+	}
+	if len(adopt) > 0 {
+		c.add(adopt...)
+		for _, inst := range adopt {
+			id := aws.StringValue(inst.InstanceId)
+			c.metrics.trackLaunch(id, c.priceForType(aws.StringValue(inst.InstanceType)))
+		}
+	}
+	for _, id := range terminate {
+		if err := c.Driver.Destroy(context.Background(), id); err != nil {
+			c.Log.Printf("destroy orphan %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// priceForType returns the configured $/hr price for instance type
+// typ in c.Region, or 0 if typ isn't one of the cluster's admissible
+// instance types. It's used by fixStaleLocks to seed the burn-rate
+// metric for an adopted instance, since adoption has no launch-time
+// scheduler.Pick to read a price from, and by
+// updateInstanceStateMetrics to price every instance in c.File.
+func (c *Cluster) priceForType(typ string) float64 {
+	for _, config := range instanceTypes {
+		if config.Type == typ {
+			return config.Price[c.Region]
+		}
+	}
+	return 0
+}
+
 // Allocate reserves an alloc with within the resource requirement
 // boundaries form this cluster. If an existing instance can serve
 // the request, it is returned immediately; otherwise new instance(s)
@@ -224,6 +413,7 @@ func (c *Cluster) need(ctx context.Context, req reflow.Requirements) <-chan stru
 		Requirements: req,
 		ctx:          ctx,
 		c:            make(chan struct{}),
+		start:        time.Now(),
 	}
 	c.wait <- w
 	return w.c
@@ -270,41 +460,75 @@ func (c *Cluster) loop() {
 		c.File.Unmarshal(&instances)
 		n := len(instances)
 		var needPoll bool
-		// Here we try to pack resource requests. First, we order each
-		// request by the "magnitude" of the request (as defined by
-		// (Resources).ScaledDistance) and then greedily pack the requests
-		// until there is no instance type that can accomodate them.
-		sort.Slice(waiters, func(i, j int) bool {
-			return waiters[i].Min.ScaledDistance(nil) < waiters[j].Min.ScaledDistance(nil)
-		})
-		var todo []instanceConfig
-		for i := 0; i < len(waiters); {
-			var need reflow.Resources
-			need.Add(need, waiters[i].Min)
-			i++
-			best, ok := c.instanceState.MinAvailable(need, c.Spot)
+		// Pack the pending waiter queue into a set of instances to
+		// launch, via the scheduler package: tasks are sorted by
+		// resource "magnitude" (ScaledDistance), largest first, and
+		// packed next-fit into the cheapest instance types
+		// c.instanceState currently has available (see
+		// scheduler.Schedule), with adjacent small picks
+		// opportunistically upsized into one larger instance.
+		configs := map[string]instanceConfig{}
+		tasks := make([]scheduler.Task, len(waiters))
+		for i, w := range waiters {
+			tasks[i] = scheduler.Task{ID: strconv.Itoa(i), Resources: w.Min}
+		}
+		pickFn := func(need reflow.Resources) (scheduler.Pick, bool) {
+			cfg, ok := c.instanceState.MinAvailable(need, c.Spot)
 			if !ok {
-				c.Log.Printf("no currently available instance type can satisfy resource requirements %v", waiters[i-1].Min)
-				continue
+				return scheduler.Pick{}, false
+			}
+			configs[cfg.Type] = cfg
+			return scheduler.Pick{Key: cfg.Type, Resources: cfg.Resources, Price: cfg.Price[c.Region]}, true
+		}
+		upsizeFn := func(a, b scheduler.Pick) (scheduler.Pick, bool) {
+			var need reflow.Resources
+			need.Add(need, a.Resources)
+			need.Add(need, b.Resources)
+			cfg, ok := c.instanceState.MinAvailable(need, c.Spot)
+			if !ok || cfg.Type == a.Key || cfg.Type == b.Key {
+				return scheduler.Pick{}, false
 			}
-			for wbest := (instanceConfig{}); i < len(waiters) && ok; i, best = i+1, wbest {
-				need.Add(need, waiters[i].Min)
-				wbest, ok = c.instanceState.MinAvailable(need, c.Spot)
+			price := cfg.Price[c.Region]
+			if price >= a.Price+b.Price {
+				return scheduler.Pick{}, false
 			}
-			todo = append(todo, best)
+			configs[cfg.Type] = cfg
+			return scheduler.Pick{Key: cfg.Type, Resources: cfg.Resources, Price: price}, true
+		}
+		decision := scheduler.Schedule(tasks, pickFn, upsizeFn, scheduler.MinCost)
+		for _, id := range decision.Unsatisfiable {
+			idx, _ := strconv.Atoi(id)
+			c.Log.Printf("no currently available instance type can satisfy resource requirements %v", waiters[idx].Min)
 		}
-		if len(waiters) > 0 && len(todo) == 0 {
+		c.Log.Debugf("queue depth %d, pending by type %v", decision.QueueLength, decision.PendingByKey)
+		c.metrics.queueDepth.Set(float64(decision.QueueLength))
+		if len(waiters) > 0 && len(decision.Launches) == 0 {
 			c.Log.Print("resource requirements are unsatisfiable by current instance selection")
 			needPoll = true
 			goto sleep
 		}
+		if len(decision.Launches) > 0 && c.EC2 == nil {
+			// Launching is still EC2-specific (see the package doc): it
+			// goes through (*instance).Go, which requires c.EC2, not
+			// through c.Driver.Create. A cluster configured with a
+			// non-EC2 Driver and no EC2 client can still discover and
+			// reap instances via c.Driver, but can't create new ones;
+			// skip the launch instead of letting (*instance).Go panic on
+			// a nil EC2 client. Waiters stay queued until their context
+			// is done or existing capacity serves them.
+			c.Log.Errorf("cannot launch new instances: no EC2 client configured (driver %T supports discovery/termination only)", c.Driver)
+			needPoll = true
+			goto sleep
+		}
+		todo := decision.Launches
 		for len(todo) > 0 && npending < maxPending && n+npending < c.MaxInstances {
-			var config instanceConfig
-			config, todo = todo[0], todo[1:]
+			var p scheduler.Pick
+			p, todo = todo[0], todo[1:]
+			config := configs[p.Key]
 			pending.Add(pending, config.Resources)
 			npending++
 			c.Log.Debugf("launch %v%v pending%v", config.Type, config.Resources, pending)
-			go launch(config, config.Price[c.Region])
+			go launch(config, p.Price)
 		}
 	sleep:
 		var pollch <-chan time.Time
@@ -318,14 +542,19 @@ func (c *Cluster) loop() {
 			npending--
 			switch {
 			case inst.Err() == nil:
+				c.metrics.launches.WithLabelValues(inst.Config.Type, c.Region, "success").Inc()
 			case errors.Is(errors.Unavailable, inst.Err()):
 				c.Log.Printf("instance type %s unavailable in region %s: %v", inst.Config.Type, c.Region, inst.Err())
 				c.instanceState.Unavailable(inst.Config)
+				c.metrics.spotUnavailable.WithLabelValues(inst.Config.Type, c.Region).Inc()
 				fallthrough
 			default:
+				c.metrics.launches.WithLabelValues(inst.Config.Type, c.Region, "failure").Inc()
 				continue
 			}
 			c.add(inst.Instance())
+			c.workers.Track(inst)
+			c.metrics.trackLaunch(aws.StringValue(inst.Instance().InstanceId), inst.Price)
 			var ws []*waiter
 			available := inst.Config.Resources
 			for _, w := range waiters {
@@ -336,6 +565,7 @@ func (c *Cluster) loop() {
 					var tmp reflow.Resources
 					tmp.Min(w.Max, available)
 					available.Sub(available, tmp)
+					c.metrics.observeWait(time.Since(w.start))
 					w.Notify()
 				} else {
 					ws = append(ws, w)
@@ -360,6 +590,8 @@ func (c *Cluster) loop() {
 func (c *Cluster) maintain() {
 	ec2Tick := time.NewTicker(ec2PollInterval)
 	updateTick := time.NewTicker(statePollInterval)
+	probeTick := time.NewTicker(statePollInterval)
+	idleTick := time.NewTicker(statePollInterval)
 	if err := c.reconcile(); err != nil {
 		c.Log.Printf("reconcile error: %v", err)
 	}
@@ -371,7 +603,57 @@ func (c *Cluster) maintain() {
 			}
 		case <-updateTick.C:
 			c.update()
+		case <-probeTick.C:
+			c.probeWorkers()
+			c.updateInstanceStateMetrics()
+		case <-idleTick.C:
+			c.reapIdle()
+		}
+	}
+}
+
+// updateInstanceStateMetrics refreshes the reflow_cluster_instances
+// and reflow_cluster_instances_by_type gauges and the burn rate from
+// c.File's persisted instance inventory -- i.e. from the live
+// instances themselves, not from any single tick's scheduling
+// decision.
+func (c *Cluster) updateInstanceStateMetrics() {
+	var instances map[string]*ec2.Instance
+	c.File.Unmarshal(&instances)
+	stateCounts := map[workerState]int{}
+	typeCounts := map[string]int{}
+	prices := map[string]float64{}
+	for id, inst := range instances {
+		stateCounts[c.workers.State(id)]++
+		typeCounts[aws.StringValue(inst.InstanceType)]++
+		prices[id] = c.priceForType(aws.StringValue(inst.InstanceType))
+	}
+	c.metrics.mu.Lock()
+	c.metrics.prices = prices
+	c.metrics.recomputeBurnRate()
+	c.metrics.mu.Unlock()
+	for _, s := range []workerState{StateUnknown, StateBooting, StateIdle, StateRunning, StateShutdown} {
+		c.metrics.instancesByState.WithLabelValues(s.String()).Set(float64(stateCounts[s]))
+	}
+	c.metrics.instancesByType.Reset()
+	for typ, n := range typeCounts {
+		c.metrics.instancesByType.WithLabelValues(typ).Set(float64(n))
+	}
+}
+
+// probeWorkers runs a boot/liveness probe pass over every tracked
+// instance and terminates any that the pool considers dead, e.g. an
+// instance whose cloud-init never brought the reflowlet up, or one
+// that has stopped answering both its HTTPS and SSH probes.
+func (c *Cluster) probeWorkers() {
+	for _, id := range c.workers.ProbeAll(context.Background()) {
+		c.Log.Printf("terminating unhealthy instance %s", id)
+		if err := c.Driver.Destroy(context.Background(), id); err != nil {
+			c.Log.Printf("destroy %s: %v", id, err)
+			continue
 		}
+		c.workers.Forget(id)
+		c.remove(id)
 	}
 }
 
@@ -399,6 +681,8 @@ func (c *Cluster) remove(instanceIds ...string) {
 	c.updateState(func(instances map[string]*ec2.Instance) {
 		for _, id := range instanceIds {
 			delete(instances, id)
+			c.workers.Forget(id)
+			c.metrics.untrack(id)
 		}
 	})
 }
@@ -414,13 +698,14 @@ func (c *Cluster) update() {
 	for id, inst := range instances {
 		if c.pools[id] == nil {
 			baseurl := fmt.Sprintf("https://%s:9000/v1/", *inst.PublicDnsName)
-			var err error
-			c.pools[*inst.InstanceId], err = client.New(
+			p, err := client.New(
 				baseurl,
 				c.HTTPClient, nil /*log.New(os.Stderr, "client: ", 0)*/)
 			if err != nil {
 				c.Log.Printf("client %s: %v", baseurl, err)
+				continue
 			}
+			c.pools[*inst.InstanceId] = &busyPool{Pool: p, id: *inst.InstanceId, workers: c.workers}
 		}
 	}
 	for id := range c.pools {
@@ -439,49 +724,24 @@ func (c *Cluster) reconcile() error {
 		}
 		return err
 	}
-	var instanceIds []*string
-	for id := range instances {
-		instanceIds = append(instanceIds, aws.String(id))
+	// List through the driver rather than calling EC2 directly, so
+	// that reconciliation works against any cloud.InstanceSet.
+	cloudInstances, err := c.Driver.List(context.Background(), cloud.Tags{"reflow": c.Tag})
+	if err != nil {
+		return err
 	}
-	// The EC2 API has a limit to the number of filters that are permissible in a single
-	// call, so we have to page through our instance IDs here.
 	live := map[string]bool{}
-	for len(instanceIds) > 0 {
-		var queryInstanceIds []*string
-		if len(instanceIds) > ec2MaxFilter {
-			queryInstanceIds = instanceIds[:ec2MaxFilter]
-			instanceIds = instanceIds[ec2MaxFilter:]
-		} else {
-			queryInstanceIds = instanceIds
-			instanceIds = nil
-		}
-		var q []string
-		for _, id := range queryInstanceIds {
-			q = append(q, *id)
-		}
-		resp, err := c.EC2.DescribeInstances(&ec2.DescribeInstancesInput{
-			Filters: []*ec2.Filter{{
-				Name:   aws.String("instance-id"),
-				Values: queryInstanceIds,
-			}},
-		})
-		if err != nil {
-			return err
-		}
-		for _, resv := range resp.Reservations {
-			for _, inst := range resv.Instances {
-				// For some reason, we keep getting unrelated instances in these
-				// requests.
-				if instances[*inst.InstanceId] == nil {
-					continue
-				}
-				switch *inst.State.Name {
-				case "shutting-down", "terminated", "stopping", "stopped":
-					c.Log.Printf("marking instance %s down: %s", *inst.InstanceId, *inst.State.Name)
-				default:
-					live[*inst.InstanceId] = true
-				}
-			}
+	for _, inst := range cloudInstances {
+		// For some reason, we keep getting unrelated instances in these
+		// requests.
+		if instances[inst.ID()] == nil {
+			continue
+		}
+		switch inst.State() {
+		case "shutting-down", "terminated", "stopping", "stopped":
+			c.Log.Printf("marking instance %s down: %s", inst.ID(), inst.State())
+		default:
+			live[inst.ID()] = true
 		}
 	}
 	var dead []string
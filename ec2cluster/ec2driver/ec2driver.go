@@ -0,0 +1,157 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package ec2driver implements the cloud.InstanceSet interface for
+// Amazon EC2. It is the default driver used by ec2cluster, and the
+// logic here was factored out of ec2cluster.Cluster's direct use of
+// ec2iface.EC2API so that the cluster's scheduling and
+// reconciliation loops are not tied to a single cloud provider.
+package ec2driver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/grailbio/reflow/cloud"
+)
+
+// ec2MaxFilter is the maximum number of filter expressions that are
+// permitted in a single EC2 API call.
+const ec2MaxFilter = 200
+
+// Driver implements cloud.InstanceSet on top of an ec2iface.EC2API
+// client. The driver operates on whatever region the EC2 client is
+// configured for.
+type Driver struct {
+	EC2 ec2iface.EC2API
+}
+
+// New returns a new EC2 driver for api.
+func New(api ec2iface.EC2API) *Driver {
+	return &Driver{EC2: api}
+}
+
+// Create is not implemented: ec2cluster.Cluster still launches
+// instances directly, via (*instance).Go, since most of the
+// EC2-specific launch parameters (AMI, security group, key pair,
+// user data, spot vs. on-demand) have no representation in
+// cloud.InstanceType/cloud.Tags. Driver is otherwise a complete,
+// usable cloud.InstanceSet: List and Destroy are used for
+// reconciliation and idle/orphan termination regardless of whether
+// Create is ever called.
+func (d *Driver) Create(ctx context.Context, typ cloud.InstanceType, tags cloud.Tags) (cloud.Instance, error) {
+	return nil, fmt.Errorf("ec2driver: Create not implemented; instances are launched via (*instance).Go")
+}
+
+// List returns the EC2 instances matching tags.
+func (d *Driver) List(ctx context.Context, tags cloud.Tags) ([]cloud.Instance, error) {
+	var filters []*ec2.Filter
+	for k, v := range tags {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(fmt.Sprintf("tag:%s", k)),
+			Values: []*string{aws.String(v)},
+		})
+	}
+	var (
+		instances []cloud.Instance
+		nextToken *string
+	)
+	for {
+		resp, err := d.EC2.DescribeInstances(&ec2.DescribeInstancesInput{
+			Filters:   filters,
+			NextToken: nextToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, resv := range resp.Reservations {
+			for _, inst := range resv.Instances {
+				instances = append(instances, &ec2Instance{inst})
+			}
+		}
+		if resp.NextToken == nil {
+			break
+		}
+		nextToken = resp.NextToken
+	}
+	return instances, nil
+}
+
+// Destroy terminates the EC2 instance with the given ID. An ID that
+// EC2 does not know is not an error.
+func (d *Driver) Destroy(ctx context.Context, id string) error {
+	_, err := d.EC2.TerminateInstances(&ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidInstanceID.NotFound" {
+		return nil
+	}
+	return err
+}
+
+// DescribeByIds is a convenience wrapper used by reconciliation code
+// that already has a (possibly large) set of instance IDs, paging
+// through EC2's per-call filter limit.
+func (d *Driver) DescribeByIds(ids []string) (map[string]*ec2.Instance, error) {
+	live := map[string]*ec2.Instance{}
+	for len(ids) > 0 {
+		var page []string
+		if len(ids) > ec2MaxFilter {
+			page, ids = ids[:ec2MaxFilter], ids[ec2MaxFilter:]
+		} else {
+			page, ids = ids, nil
+		}
+		var idPtrs []*string
+		for _, id := range page {
+			idPtrs = append(idPtrs, aws.String(id))
+		}
+		resp, err := d.EC2.DescribeInstances(&ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{{
+				Name:   aws.String("instance-id"),
+				Values: idPtrs,
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, resv := range resp.Reservations {
+			for _, inst := range resv.Instances {
+				live[*inst.InstanceId] = inst
+			}
+		}
+	}
+	return live, nil
+}
+
+// ec2Instance adapts an *ec2.Instance to cloud.Instance.
+type ec2Instance struct {
+	inst *ec2.Instance
+}
+
+func (i *ec2Instance) ID() string {
+	return aws.StringValue(i.inst.InstanceId)
+}
+
+func (i *ec2Instance) Address() string {
+	return aws.StringValue(i.inst.PublicDnsName)
+}
+
+func (i *ec2Instance) State() string {
+	if i.inst.State == nil {
+		return ""
+	}
+	return aws.StringValue(i.inst.State.Name)
+}
+
+func (i *ec2Instance) Tags() cloud.Tags {
+	tags := cloud.Tags{}
+	for _, t := range i.inst.Tags {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags
+}
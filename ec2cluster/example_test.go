@@ -0,0 +1,22 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster_test
+
+import (
+	"github.com/grailbio/reflow/cloud"
+	"github.com/grailbio/reflow/ec2cluster"
+	"github.com/grailbio/reflow/ec2cluster/gcedriver"
+)
+
+// Example_gceDriver shows that Cluster.Driver is a genuine extension
+// point: a caller can substitute the default ec2driver with any
+// other cloud.InstanceSet, such as gcedriver, before calling Init.
+// It has no "Output:" comment, so it is compiled but not executed.
+func Example_gceDriver() {
+	c := &ec2cluster.Cluster{
+		Driver: gcedriver.New(nil, "my-project", "us-central1-a"),
+	}
+	var _ cloud.InstanceSet = c.Driver
+}
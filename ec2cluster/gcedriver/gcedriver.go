@@ -0,0 +1,130 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package gcedriver implements the cloud.InstanceSet interface for
+// Google Compute Engine. It implements just enough of the GCE
+// Compute API to list and destroy tagged instances in a
+// project/zone, and is set as an ec2cluster.Cluster's Driver field
+// in place of the default ec2driver (see ec2cluster's Example_gceDriver)
+// to exercise the cloud.InstanceSet abstraction against a second
+// provider. This makes gcedriver usable for discovery and
+// termination (reconciliation, idle/orphan reaping) only: Cluster
+// doesn't yet route new-instance launches through Driver.Create at
+// all (it always launches via the EC2-specific (*instance).Go), so a
+// GCE-only cluster can't scale up. Create returns an error
+// accordingly; once launching is routed through Driver, Create
+// should mirror ec2driver's instance launch logic using GCE instance
+// templates.
+package gcedriver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/grailbio/reflow/cloud"
+)
+
+// Driver implements cloud.InstanceSet on top of the GCE Compute API.
+type Driver struct {
+	Service *compute.Service
+	Project string
+	Zone    string
+}
+
+// New returns a new GCE driver for the given project and zone.
+func New(service *compute.Service, project, zone string) *Driver {
+	return &Driver{Service: service, Project: project, Zone: zone}
+}
+
+// Create is not yet implemented for GCE; see package doc.
+func (d *Driver) Create(ctx context.Context, typ cloud.InstanceType, tags cloud.Tags) (cloud.Instance, error) {
+	return nil, fmt.Errorf("gcedriver: Create not implemented")
+}
+
+// List returns the GCE instances in d.Project/d.Zone whose labels
+// are a superset of tags.
+func (d *Driver) List(ctx context.Context, tags cloud.Tags) ([]cloud.Instance, error) {
+	var instances []cloud.Instance
+	call := d.Service.Instances.List(d.Project, d.Zone)
+	err := call.Pages(ctx, func(page *compute.InstanceList) error {
+		for _, inst := range page.Items {
+			if !hasLabels(inst.Labels, tags) {
+				continue
+			}
+			instances = append(instances, &gceInstance{inst})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return instances, nil
+}
+
+// Destroy deletes the GCE instance with the given name. An instance
+// that no longer exists is not an error.
+func (d *Driver) Destroy(ctx context.Context, id string) error {
+	_, err := d.Service.Instances.Delete(d.Project, d.Zone, id).Context(ctx).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func hasLabels(have map[string]string, want cloud.Tags) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// gceInstance adapts a *compute.Instance to cloud.Instance.
+type gceInstance struct {
+	inst *compute.Instance
+}
+
+func (i *gceInstance) ID() string {
+	return i.inst.Name
+}
+
+func (i *gceInstance) Address() string {
+	for _, iface := range i.inst.NetworkInterfaces {
+		for _, cfg := range iface.AccessConfigs {
+			if cfg.NatIP != "" {
+				return cfg.NatIP
+			}
+		}
+	}
+	return ""
+}
+
+// State reports the instance's GCE status in the lower-case,
+// EC2-style lifecycle names that ec2cluster's reconciliation checks
+// for; e.g. TERMINATED is reported as "stopped".
+func (i *gceInstance) State() string {
+	switch i.inst.Status {
+	case "PROVISIONING", "STAGING":
+		return "pending"
+	case "STOPPING", "SUSPENDING":
+		return "stopping"
+	case "TERMINATED", "STOPPED", "SUSPENDED":
+		return "stopped"
+	}
+	return strings.ToLower(i.inst.Status)
+}
+
+func (i *gceInstance) Tags() cloud.Tags {
+	tags := cloud.Tags{}
+	for k, v := range i.inst.Labels {
+		tags[k] = v
+	}
+	return tags
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grailbio/reflow/pool"
+)
+
+// allocLister is implemented by pool.Pool implementations (such as
+// the reflowlet client pools in c.pools) that can report their
+// current set of allocs. It's used by reapIdle to tell whether an
+// instance has any live sub-allocations.
+type allocLister interface {
+	Allocs(ctx context.Context) ([]pool.Alloc, error)
+}
+
+// reapIdle terminates instances that have had no running alloc for
+// longer than c.IdleTimeout. This is independent of (and a good deal
+// more aggressive than) the reflowlet's own billing-hour
+// self-terminate, and lets operators cap spend on clusters whose
+// reflowlets have been patched to be immortal. Up to c.MinIdle
+// instances of the cluster's most-requested instance type are kept
+// warm regardless of idle time, to absorb the first Allocate of a
+// new run without waiting out a launch. Instances that c.workers
+// does not track (e.g. ones launched by another process sharing
+// c.File) have no recorded busy time and are left alone.
+func (c *Cluster) reapIdle() {
+	if c.IdleTimeout <= 0 {
+		return
+	}
+	var instances map[string]*ec2.Instance
+	c.File.Unmarshal(&instances)
+
+	typeCounts := map[string]int{}
+	for _, inst := range instances {
+		typeCounts[aws.StringValue(inst.InstanceType)]++
+	}
+	// Pick the most-requested type deterministically: break ties by
+	// type name rather than by map iteration order, which would
+	// otherwise let the warm pool flap between tied types across
+	// ticks.
+	var mostRequested string
+	for typ, count := range typeCounts {
+		if count > typeCounts[mostRequested] || (count == typeCounts[mostRequested] && typ < mostRequested) {
+			mostRequested = typ
+		}
+	}
+
+	// Refresh each instance's busy state from its current allocs. This
+	// backstops the event-driven MarkBusy calls hooked into the pool's
+	// Offer.Accept path (see busyPool in worker.go) for allocs that
+	// were already running before this process started tracking them.
+	for id := range instances {
+		if lister, ok := c.pools[id].(allocLister); ok {
+			if allocs, err := lister.Allocs(context.Background()); err != nil {
+				c.Log.Debugf("reapIdle: allocs %s: %v", id, err)
+			} else if len(allocs) > 0 {
+				c.workers.MarkBusy(id)
+			}
+		}
+	}
+
+	// Select the warm pool deterministically: the up-to-MinIdle
+	// instances of the most-requested type that were busiest most
+	// recently. Iterating instances directly (a map) would make the
+	// warm set rotate randomly every tick, since Go map iteration
+	// order isn't stable.
+	var candidates []string
+	for id, inst := range instances {
+		if aws.StringValue(inst.InstanceType) == mostRequested {
+			candidates = append(candidates, id)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return c.workers.LastBusy(candidates[i]).After(c.workers.LastBusy(candidates[j]))
+	})
+	warm := map[string]bool{}
+	for i := 0; i < len(candidates) && i < c.MinIdle; i++ {
+		warm[candidates[i]] = true
+	}
+
+	now := time.Now()
+	for id := range instances {
+		if warm[id] {
+			continue
+		}
+		last := c.workers.LastBusy(id)
+		if last.IsZero() || now.Sub(last) < c.IdleTimeout {
+			continue
+		}
+		c.Log.Printf("terminating idle instance %s (idle longer than %s)", id, c.IdleTimeout)
+		if err := c.Driver.Destroy(context.Background(), id); err != nil {
+			c.Log.Printf("destroy idle instance %s: %v", id, err)
+			continue
+		}
+		c.remove(id)
+	}
+}
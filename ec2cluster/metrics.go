@@ -0,0 +1,116 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// clusterMetrics holds the Prometheus collectors published by
+// Cluster's /metrics endpoint: instance counts by state and type,
+// waiter queue depth and wait-time, launch outcomes, spot
+// unavailability events, and current spend rate.
+type clusterMetrics struct {
+	registry *prometheus.Registry
+
+	instancesByState *prometheus.GaugeVec
+	instancesByType  *prometheus.GaugeVec
+	queueDepth       prometheus.Gauge
+	waiterWaitTime   prometheus.Histogram
+	launches         *prometheus.CounterVec
+	spotUnavailable  *prometheus.CounterVec
+	burnRate         prometheus.Gauge
+
+	mu     sync.Mutex
+	prices map[string]float64 // instance id -> $/hr, for burnRate
+}
+
+func newClusterMetrics() *clusterMetrics {
+	m := &clusterMetrics{
+		registry: prometheus.NewRegistry(),
+		instancesByState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "reflow_cluster_instances",
+			Help: "Number of cluster instances by lifecycle state.",
+		}, []string{"state"}),
+		instancesByType: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "reflow_cluster_instances_by_type",
+			Help: "Number of live cluster instances by instance type.",
+		}, []string{"type"}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reflow_cluster_waiter_queue_depth",
+			Help: "Number of allocation requests waiting for capacity.",
+		}),
+		waiterWaitTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "reflow_cluster_waiter_wait_seconds",
+			Help:    "Time an allocation request spent waiting for capacity.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12), // 1s .. ~34m
+		}),
+		launches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reflow_cluster_launches_total",
+			Help: "Instance launch attempts by instance type, region, and outcome.",
+		}, []string{"type", "region", "outcome"}),
+		spotUnavailable: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "reflow_cluster_spot_unavailable_total",
+			Help: "Spot capacity unavailability events by instance type and region.",
+		}, []string{"type", "region"}),
+		burnRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "reflow_cluster_burn_rate_dollars_per_hour",
+			Help: "Current approximate $/hr spend across all live instances.",
+		}),
+		prices: map[string]float64{},
+	}
+	m.registry.MustRegister(
+		m.instancesByState, m.instancesByType, m.queueDepth,
+		m.waiterWaitTime, m.launches, m.spotUnavailable, m.burnRate,
+	)
+	return m
+}
+
+// Handler returns the metrics' HTTP handler.
+func (m *clusterMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// trackLaunch records that the instance with the given id is live
+// and billing at price $/hr, updating the aggregate burn rate.
+func (m *clusterMetrics) trackLaunch(id string, price float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prices[id] = price
+	m.recomputeBurnRate()
+}
+
+// untrack removes id from the burn-rate computation, e.g. once it's
+// been terminated.
+func (m *clusterMetrics) untrack(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.prices, id)
+	m.recomputeBurnRate()
+}
+
+func (m *clusterMetrics) recomputeBurnRate() {
+	var total float64
+	for _, price := range m.prices {
+		total += price
+	}
+	m.burnRate.Set(total)
+}
+
+func (m *clusterMetrics) observeWait(d time.Duration) {
+	m.waiterWaitTime.Observe(d.Seconds())
+}
+
+// MetricsHandler returns an http.Handler that serves the cluster's
+// Prometheus metrics. Callers mount it, e.g. under "/metrics", on
+// whatever HTTP server they use to expose cluster diagnostics.
+func (c *Cluster) MetricsHandler() http.Handler {
+	return c.metrics.Handler()
+}
@@ -0,0 +1,464 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package ec2cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/grailbio/reflow/log"
+	"github.com/grailbio/reflow/pool"
+)
+
+// workerState describes where an instance is in its boot/run
+// lifecycle, as tracked by a workerPool: unprobed, booting, idle,
+// running an alloc, or shut down.
+type workerState int
+
+const (
+	// StateUnknown is the state of an instance the pool has not yet
+	// probed at all.
+	StateUnknown workerState = iota
+	// StateBooting is an instance that EC2 reports as running but
+	// whose reflowlet has not yet answered a boot probe.
+	StateBooting
+	// StateIdle is an instance whose reflowlet is up and has no
+	// running allocs.
+	StateIdle
+	// StateRunning is an instance whose reflowlet is up and has at
+	// least one running alloc.
+	StateRunning
+	// StateShutdown is an instance whose boot probe timed out or
+	// whose liveness probe failed three times in a row, and which is
+	// being terminated. Instances the cloud reports as terminated or
+	// stopped are dropped from the pool (see Cluster.remove) rather
+	// than kept in this state.
+	StateShutdown
+)
+
+func (s workerState) String() string {
+	switch s {
+	case StateBooting:
+		return "booting"
+	case StateIdle:
+		return "idle"
+	case StateRunning:
+		return "running"
+	case StateShutdown:
+		return "shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// bootOutcome records the result of an instance's most recent boot
+// probe attempt.
+type bootOutcome int
+
+const (
+	bootOutcomeUnknown bootOutcome = iota
+	bootOutcomeSucceeded
+	bootOutcomeFailed
+)
+
+// sshExecutor runs commands on an instance over SSH. It is used as
+// the fallback path for probing instances whose reflowlet HTTPS
+// endpoint is not (yet, or no longer) reachable, and as the
+// transport for the initial boot probe, which runs before the
+// reflowlet's HTTPS server can be expected to have mutual-TLS
+// credentials in place.
+type sshExecutor interface {
+	// Run executes cmd on the instance at address and returns its
+	// combined output.
+	Run(ctx context.Context, address, cmd string) ([]byte, error)
+}
+
+// worker tracks the lifecycle of a single cloud instance as owned by
+// a workerPool.
+type worker struct {
+	// address is the instance's reachable network address (public
+	// DNS name), used for probing. It's captured at Track time rather
+	// than read through instance, since a worker may be created for
+	// an adopted instance that was never launched in this process
+	// (see workerPool.TrackAdopted).
+	address string
+
+	mu            sync.Mutex
+	state         workerState
+	firstBoot     time.Time
+	lastProbe     time.Time
+	lastBusy      time.Time
+	bootOutcome   bootOutcome
+	consecutiveNG int
+}
+
+// workerPool tracks the boot and health state of every instance
+// belonging to a Cluster, using an SSH executor to probe instances
+// whose reflowlet HTTPS endpoint is not reachable. It lets
+// Cluster.probeWorkers distinguish an instance whose cloud-init never
+// brought up the reflowlet from one that is healthy but simply idle.
+type workerPool struct {
+	// HTTPClient probes the reflowlet's HTTPS health endpoint.
+	HTTPClient *http.Client
+	// SSH is used for the initial boot probe and as a fallback
+	// liveness probe when the HTTPS endpoint is unreachable.
+	SSH sshExecutor
+	// BootProbeCommand is run over SSH to verify that the reflowlet
+	// process started successfully.
+	BootProbeCommand string
+	// BootTimeout bounds how long an instance may remain in
+	// StateBooting before it is considered a failed boot.
+	BootTimeout time.Duration
+	// Log is used to report state transitions and probe failures.
+	Log *log.Logger
+	// Allocs returns the currently running allocs for the instance
+	// with the given ID, if known. probe uses it to demote a worker
+	// from StateRunning back to StateIdle once its last alloc
+	// completes; it mirrors the allocLister check idle.go's reapIdle
+	// uses as a backstop for the event-driven MarkBusy calls in
+	// busyOffer.Accept. It's set by Cluster.Init; a nil Allocs leaves
+	// workers that have ever gone busy stuck in StateRunning.
+	Allocs func(ctx context.Context, id string) ([]pool.Alloc, error)
+
+	mu      sync.Mutex
+	workers map[string]*worker
+}
+
+// newWorkerPool returns an empty workerPool.
+func newWorkerPool(httpClient *http.Client, ssh sshExecutor, bootProbeCommand string, bootTimeout time.Duration, logger *log.Logger) *workerPool {
+	return &workerPool{
+		HTTPClient:       httpClient,
+		SSH:              ssh,
+		BootProbeCommand: bootProbeCommand,
+		BootTimeout:      bootTimeout,
+		Log:              logger,
+		workers:          map[string]*worker{},
+	}
+}
+
+// Track begins tracking inst, if it is not already tracked, in
+// StateUnknown.
+func (p *workerPool) Track(inst *instance) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := inst.Instance().InstanceId
+	if id == nil {
+		return
+	}
+	if _, ok := p.workers[*id]; ok {
+		return
+	}
+	p.workers[*id] = &worker{
+		address:   aws.StringValue(inst.Instance().PublicDnsName),
+		firstBoot: time.Now(),
+	}
+}
+
+// TrackAdopted begins tracking an instance that this process didn't
+// launch itself but has just adopted (see Cluster.fixStaleLocks),
+// already confirmed reachable at address. It starts the worker in
+// StateIdle, since adoption only happens after a successful liveness
+// probe.
+func (p *workerPool) TrackAdopted(id, address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.workers[id]; ok {
+		return
+	}
+	now := time.Now()
+	p.workers[id] = &worker{
+		address:     address,
+		firstBoot:   now,
+		lastProbe:   now,
+		lastBusy:    now,
+		state:       StateIdle,
+		bootOutcome: bootOutcomeSucceeded,
+	}
+}
+
+// Forget stops tracking the instance with the given ID, e.g. once it
+// has been reconciled away.
+func (p *workerPool) Forget(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.workers, id)
+}
+
+// State returns the current state of the instance with the given
+// ID, or StateUnknown if it is not tracked.
+func (p *workerPool) State(id string) workerState {
+	p.mu.Lock()
+	w, ok := p.workers[id]
+	p.mu.Unlock()
+	if !ok {
+		return StateUnknown
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+// MarkBusy records that the instance with the given ID has an
+// active alloc, transitioning it to StateRunning.
+func (p *workerPool) MarkBusy(id string) {
+	p.mu.Lock()
+	w, ok := p.workers[id]
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	w.lastBusy = time.Now()
+	w.state = StateRunning
+	w.mu.Unlock()
+}
+
+// LastBusy returns the last time the instance with the given ID was
+// observed to have an active alloc. For an instance that has never
+// been busy, it returns the time the instance was first tracked
+// (i.e. its boot time), so that a freshly-launched instance isn't
+// immediately treated as idle. It returns the zero Time if id isn't
+// tracked at all.
+func (p *workerPool) LastBusy(id string) time.Time {
+	p.mu.Lock()
+	w, ok := p.workers[id]
+	p.mu.Unlock()
+	if !ok {
+		return time.Time{}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lastBusy.IsZero() {
+		return w.firstBoot
+	}
+	return w.lastBusy
+}
+
+// ProbeAll probes every tracked worker once: boot probes for those
+// still in StateBooting, and liveness probes for the rest. It
+// returns the IDs of instances whose boot failed or whose liveness
+// probe has failed for long enough that they should be terminated.
+func (p *workerPool) ProbeAll(ctx context.Context) (failed []string) {
+	p.mu.Lock()
+	ws := make(map[string]*worker, len(p.workers))
+	for id, w := range p.workers {
+		ws[id] = w
+	}
+	p.mu.Unlock()
+	for id, w := range ws {
+		if p.probe(ctx, id, w) {
+			failed = append(failed, id)
+		}
+	}
+	return failed
+}
+
+// probe runs the appropriate probe for w's current state and
+// updates w's state accordingly. It returns true if w should be
+// considered dead and terminated.
+func (p *workerPool) probe(ctx context.Context, id string, w *worker) bool {
+	w.mu.Lock()
+	state := w.state
+	firstBoot := w.firstBoot
+	addr := w.address
+	w.mu.Unlock()
+
+	if state == StateShutdown {
+		return true
+	}
+	if state == StateUnknown || state == StateBooting {
+		ok := p.bootProbe(ctx, addr)
+		w.mu.Lock()
+		w.lastProbe = time.Now()
+		if ok {
+			w.state = StateIdle
+			w.bootOutcome = bootOutcomeSucceeded
+			w.mu.Unlock()
+			p.Log.Debugf("worker %s: boot probe succeeded", id)
+			return false
+		}
+		w.state = StateBooting
+		timedOut := p.BootTimeout > 0 && time.Since(firstBoot) > p.BootTimeout
+		if timedOut {
+			w.bootOutcome = bootOutcomeFailed
+			w.state = StateShutdown
+		}
+		w.mu.Unlock()
+		if timedOut {
+			p.Log.Printf("worker %s: boot probe failed for %s; terminating", id, time.Since(firstBoot))
+			return true
+		}
+		return false
+	}
+
+	ok := p.livenessProbe(ctx, addr)
+	if !ok {
+		w.mu.Lock()
+		w.lastProbe = time.Now()
+		w.consecutiveNG++
+		ng := w.consecutiveNG
+		if ng >= 3 {
+			w.state = StateShutdown
+		}
+		w.mu.Unlock()
+		if ng >= 3 {
+			p.Log.Printf("worker %s: liveness probe failed %d times in a row; terminating", id, ng)
+			return true
+		}
+		return false
+	}
+
+	w.mu.Lock()
+	w.lastProbe = time.Now()
+	w.consecutiveNG = 0
+	wasRunning := w.state == StateRunning
+	if !wasRunning {
+		w.state = StateIdle
+	}
+	w.mu.Unlock()
+	if !wasRunning {
+		return false
+	}
+
+	// A worker that has gone busy stays in StateRunning until its
+	// allocs actually drain, rather than being demoted the moment a
+	// single probe succeeds; this mirrors reapIdle's own use of
+	// Allocs as a backstop for busyOffer.Accept's event-driven
+	// MarkBusy. The Allocs call happens with w.mu released, since it's
+	// an RPC; demotion below only takes effect if the worker is still
+	// StateRunning once it returns, so a concurrent MarkBusy for a new
+	// alloc accepted in the meantime isn't clobbered.
+	demote := false
+	if p.Allocs != nil {
+		allocsCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		allocs, err := p.Allocs(allocsCtx, id)
+		cancel()
+		if err != nil {
+			p.Log.Debugf("worker %s: allocs: %v", id, err)
+		} else if len(allocs) == 0 {
+			demote = true
+		}
+	}
+	if demote {
+		w.mu.Lock()
+		if w.state == StateRunning {
+			w.state = StateIdle
+		}
+		w.mu.Unlock()
+	}
+	return false
+}
+
+// bootProbe verifies that the reflowlet started via SSH, since the
+// reflowlet's mutually-authenticated HTTPS server may not be ready
+// (or cloud-init may not have run at all) this early in an
+// instance's life. Without an SSH executor it probes the reflowlet's
+// HTTPS endpoint instead.
+func (p *workerPool) bootProbe(ctx context.Context, address string) bool {
+	if address == "" {
+		return false
+	}
+	if p.SSH == nil {
+		return p.httpProbe(ctx, address)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := p.SSH.Run(ctx, address, p.BootProbeCommand)
+	return err == nil
+}
+
+// livenessProbe checks whether the reflowlet is still answering,
+// preferring its HTTPS endpoint and falling back to an SSH-based
+// check (e.g. that the reflowlet's process is still alive) if the
+// HTTPS endpoint is unreachable.
+func (p *workerPool) livenessProbe(ctx context.Context, address string) bool {
+	if address == "" {
+		return false
+	}
+	if p.httpProbe(ctx, address) {
+		return true
+	}
+	if p.SSH == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := p.SSH.Run(ctx, address, p.BootProbeCommand)
+	return err == nil
+}
+
+func (p *workerPool) httpProbe(ctx context.Context, address string) bool {
+	url := fmt.Sprintf("https://%s:9000/v1/", address)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	req = req.WithContext(ctx)
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
+
+// busyPool wraps the pool.Pool for a single instance so that
+// workers.MarkBusy is called the moment an offer on that instance is
+// accepted, rather than being discovered later by polling Allocs.
+// This catches allocs that start and complete between reapIdle's
+// periodic polls; see Cluster.update, which constructs one of these
+// per instance, and reapIdle, which still polls Allocs as a
+// backstop for allocs that were already running before this process
+// started tracking them.
+type busyPool struct {
+	pool.Pool
+	id      string
+	workers *workerPool
+}
+
+func (b *busyPool) Offers(ctx context.Context) ([]pool.Offer, error) {
+	offers, err := b.Pool.Offers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := make([]pool.Offer, len(offers))
+	for i, o := range offers {
+		wrapped[i] = &busyOffer{Offer: o, id: b.id, workers: b.workers}
+	}
+	return wrapped, nil
+}
+
+func (b *busyPool) Offer(ctx context.Context, id string) (pool.Offer, error) {
+	o, err := b.Pool.Offer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &busyOffer{Offer: o, id: b.id, workers: b.workers}, nil
+}
+
+// busyOffer wraps a pool.Offer so that accepting it marks the owning
+// instance busy synchronously, instead of waiting for the next
+// Allocs poll to notice the new alloc.
+type busyOffer struct {
+	pool.Offer
+	id      string
+	workers *workerPool
+}
+
+func (o *busyOffer) Accept(ctx context.Context, labels pool.Labels) (pool.Alloc, error) {
+	alloc, err := o.Offer.Accept(ctx, labels)
+	if err == nil {
+		o.workers.MarkBusy(o.id)
+	}
+	return alloc, err
+}
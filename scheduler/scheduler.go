@@ -0,0 +1,155 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package scheduler implements the bin-packing policy used to turn
+// a queue of pending resource requirements into a set of instances
+// to launch: tasks are sorted by size, largest first, and packed
+// next-fit into groups, each launched on the cheapest instance type
+// that fits it, and adjacent small groups are opportunistically
+// "upsized" into a single larger instance when that's cheaper than
+// launching both.
+//
+// Schedule is decoupled from any particular cloud's instance
+// catalog: callers supply a Pick function that maps a resource
+// requirement to the cheapest available instance type (as
+// determined by, e.g., ec2cluster's instanceState), and an optional
+// Upsize function that attempts to combine two picks into one
+// larger instance type.
+package scheduler
+
+import (
+	"sort"
+
+	"github.com/grailbio/reflow"
+)
+
+// Objective selects among the possible ways of satisfying the
+// queue, trading off cost, wall-clock time, and instance count.
+type Objective int
+
+const (
+	// MinCost prefers the packing with the lowest aggregate $/hr.
+	// This is the default and only objective Schedule currently
+	// implements; MinWallTime and MinCount are reserved for when
+	// Reflow has the per-instance-type throughput data needed to
+	// estimate them.
+	MinCost Objective = iota
+	// MinWallTime prefers the packing that finishes the queue soonest.
+	MinWallTime
+	// MinCount prefers the packing that launches the fewest instances.
+	MinCount
+)
+
+// Task is a single queued resource requirement, e.g. a Reflow
+// waiter. ID is opaque to Schedule and is only used to report which
+// tasks could not be satisfied.
+type Task struct {
+	ID        string
+	Resources reflow.Resources
+}
+
+// Pick describes an available instance type as returned by a
+// PickFunc. Key is opaque to Schedule; callers use it to recover
+// their own instance configuration from the Launches in a Decision.
+type Pick struct {
+	Key       string
+	Resources reflow.Resources
+	Price     float64
+}
+
+// PickFunc returns the cheapest instance type that can satisfy need,
+// or ok=false if no instance type can.
+type PickFunc func(need reflow.Resources) (pick Pick, ok bool)
+
+// UpsizeFunc attempts to combine two picks' resource requirements
+// into a single, larger instance type. It returns ok=false if no
+// single instance type dominates both, or if the combined type is
+// not cheaper than a+b's combined price.
+type UpsizeFunc func(a, b Pick) (combined Pick, ok bool)
+
+// Decision is the result of a Schedule call.
+type Decision struct {
+	// Launches is the set of instances to create, one per launch.
+	Launches []Pick
+	// QueueLength is the number of tasks that were considered.
+	QueueLength int
+	// PendingByKey counts, by Pick.Key, how many instances of that
+	// type are being launched.
+	PendingByKey map[string]int
+	// Unsatisfiable lists the IDs of tasks that no available
+	// instance type could satisfy, even alone.
+	Unsatisfiable []string
+}
+
+// Schedule packs tasks onto instance types returned by pick, in
+// decreasing order of each task's ScaledDistance: a group takes
+// consecutive tasks until the next one would leave no instance type
+// that fits the group, and that task starts the next group. Earlier
+// groups are not revisited, so a task is never placed into an
+// earlier group it would still fit. Schedule then attempts to merge
+// adjacent picks using upsize when doing so is cheaper. tasks is not
+// modified.
+//
+// Only the MinCost objective is currently implemented; other values
+// of objective are accepted but behave identically to MinCost.
+func Schedule(tasks []Task, pick PickFunc, upsize UpsizeFunc, objective Objective) Decision {
+	d := Decision{QueueLength: len(tasks), PendingByKey: map[string]int{}}
+
+	sorted := make([]Task, len(tasks))
+	copy(sorted, tasks)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Resources.ScaledDistance(nil) > sorted[j].Resources.ScaledDistance(nil)
+	})
+
+	var picks []Pick
+	for i := 0; i < len(sorted); {
+		var need reflow.Resources
+		need.Add(need, sorted[i].Resources)
+		best, ok := pick(need)
+		if !ok {
+			d.Unsatisfiable = append(d.Unsatisfiable, sorted[i].ID)
+			i++
+			continue
+		}
+		i++
+		// Next-fit: keep adding the next (smaller, since sorted is
+		// descending) task into this same instance as long as some
+		// instance type still fits the running total; the first task
+		// that doesn't fit starts the next group.
+		for i < len(sorted) {
+			need.Add(need, sorted[i].Resources)
+			next, ok := pick(need)
+			if !ok {
+				break
+			}
+			best = next
+			i++
+		}
+		picks = append(picks, best)
+	}
+
+	// Attempt to upsize adjacent pairs of picks: if combining two
+	// picks' resource needs fits a single, cheaper instance type,
+	// launch that instead of the two smaller ones.
+	if upsize != nil {
+		merged := picks[:0]
+		for i := 0; i < len(picks); i++ {
+			if i+1 < len(picks) {
+				if combined, ok := upsize(picks[i], picks[i+1]); ok {
+					merged = append(merged, combined)
+					i++
+					continue
+				}
+			}
+			merged = append(merged, picks[i])
+		}
+		picks = merged
+	}
+
+	d.Launches = picks
+	for _, p := range picks {
+		d.PendingByKey[p.Key]++
+	}
+	return d
+}
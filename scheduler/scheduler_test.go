@@ -0,0 +1,138 @@
+// Copyright 2017 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grailbio/reflow"
+)
+
+// testCatalog is a small synthetic instance catalog, in the spirit
+// of Arvados' run_queue_test.go, used to drive Schedule without a
+// live cloud.
+var testCatalog = []struct {
+	typ   string
+	cpu   float64
+	price float64
+}{
+	{"micro", 1, 0.05},
+	{"small", 2, 0.09},
+	{"medium", 4, 0.15},
+	{"large", 8, 0.26},
+}
+
+func testPick(need reflow.Resources) (Pick, bool) {
+	best := -1
+	for i, e := range testCatalog {
+		if e.cpu < need["cpu"] {
+			continue
+		}
+		if best == -1 || e.price < testCatalog[best].price {
+			best = i
+		}
+	}
+	if best == -1 {
+		return Pick{}, false
+	}
+	e := testCatalog[best]
+	return Pick{Key: e.typ, Resources: reflow.Resources{"cpu": e.cpu}, Price: e.price}, true
+}
+
+func task(id string, cpu float64) Task {
+	return Task{ID: id, Resources: reflow.Resources{"cpu": cpu}}
+}
+
+func TestScheduleBinPacksDecreasing(t *testing.T) {
+	tasks := []Task{task("t0", 1), task("t1", 1)}
+	d := Schedule(tasks, testPick, nil, MinCost)
+	if len(d.Unsatisfiable) != 0 {
+		t.Fatalf("unexpected unsatisfiable tasks: %v", d.Unsatisfiable)
+	}
+	if len(d.Launches) != 1 || d.Launches[0].Key != "small" {
+		t.Fatalf("expected the two 1-cpu tasks to pack into a single small instance, got %v", d.Launches)
+	}
+	if want := map[string]int{"small": 1}; !reflect.DeepEqual(d.PendingByKey, want) {
+		t.Errorf("PendingByKey = %v, want %v", d.PendingByKey, want)
+	}
+}
+
+func TestScheduleUnsatisfiable(t *testing.T) {
+	tasks := []Task{task("t0", 1), task("t1", 100)}
+	d := Schedule(tasks, testPick, nil, MinCost)
+	if want := []string{"t1"}; !reflect.DeepEqual(d.Unsatisfiable, want) {
+		t.Fatalf("Unsatisfiable = %v, want %v", d.Unsatisfiable, want)
+	}
+	if len(d.Launches) != 1 || d.Launches[0].Key != "micro" {
+		t.Fatalf("expected the satisfiable task to still be scheduled, got %v", d.Launches)
+	}
+}
+
+func TestScheduleDefaultsToSeparateBinsWithoutUpsize(t *testing.T) {
+	// A pick that can never satisfy more than one task per bin (as a
+	// real instance type's finite capacity would) forces one bin per
+	// task when no UpsizeFunc is supplied.
+	oneEach := func(need reflow.Resources) (Pick, bool) {
+		if need["cpu"] > 1 {
+			return Pick{}, false
+		}
+		return Pick{Key: "small", Resources: reflow.Resources{"cpu": 1}, Price: 0.10}, true
+	}
+	tasks := []Task{task("t0", 1), task("t1", 1)}
+	d := Schedule(tasks, oneEach, nil, MinCost)
+	if want := map[string]int{"small": 2}; !reflect.DeepEqual(d.PendingByKey, want) {
+		t.Errorf("PendingByKey = %v, want %v", d.PendingByKey, want)
+	}
+}
+
+func TestScheduleUpsizeMergesAdjacentPicks(t *testing.T) {
+	// Same one-task-per-bin pick as above, but this time an
+	// UpsizeFunc is willing to combine two adjacent "small" bins into
+	// one cheaper "big" one; Schedule should apply it and launch a
+	// single instance instead of two.
+	oneEach := func(need reflow.Resources) (Pick, bool) {
+		if need["cpu"] > 1 {
+			return Pick{}, false
+		}
+		return Pick{Key: "small", Resources: reflow.Resources{"cpu": 1}, Price: 0.10}, true
+	}
+	var upsizeCalls int
+	upsize := func(a, b Pick) (Pick, bool) {
+		upsizeCalls++
+		if a.Key != "small" || b.Key != "small" {
+			return Pick{}, false
+		}
+		return Pick{Key: "big", Resources: reflow.Resources{"cpu": 2}, Price: 0.15}, true
+	}
+	tasks := []Task{task("t0", 1), task("t1", 1)}
+	d := Schedule(tasks, oneEach, upsize, MinCost)
+	if upsizeCalls == 0 {
+		t.Fatal("expected upsize to be consulted on the two adjacent small picks")
+	}
+	if len(d.Launches) != 1 || d.Launches[0].Key != "big" {
+		t.Fatalf("expected the two small bins to be upsized into one big instance, got %v", d.Launches)
+	}
+	if want := map[string]int{"big": 1}; !reflect.DeepEqual(d.PendingByKey, want) {
+		t.Errorf("PendingByKey = %v, want %v", d.PendingByKey, want)
+	}
+}
+
+func TestScheduleUpsizeDeclined(t *testing.T) {
+	// When upsize declines (e.g. because the combined instance isn't
+	// cheaper), the two bins are launched separately.
+	oneEach := func(need reflow.Resources) (Pick, bool) {
+		if need["cpu"] > 1 {
+			return Pick{}, false
+		}
+		return Pick{Key: "small", Resources: reflow.Resources{"cpu": 1}, Price: 0.10}, true
+	}
+	declineUpsize := func(a, b Pick) (Pick, bool) { return Pick{}, false }
+	tasks := []Task{task("t0", 1), task("t1", 1)}
+	d := Schedule(tasks, oneEach, declineUpsize, MinCost)
+	if want := map[string]int{"small": 2}; !reflect.DeepEqual(d.PendingByKey, want) {
+		t.Errorf("PendingByKey = %v, want %v", d.PendingByKey, want)
+	}
+}